@@ -0,0 +1,380 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Frame is a single JPEG image read from an upstream source, tagged with
+// the metadata needed to republish it downstream.
+type Frame struct {
+	Data        []byte
+	ContentType string
+	Time        time.Time
+	Seq         uint64
+}
+
+// Chunker reads a multipart MJPEG stream from one of a list of upstream
+// sources and republishes individual frames on its output channel. When the
+// current upstream errors out or stalls for longer than frameTimeout, the
+// Chunker fails over to the next source in the list instead of giving up.
+type Chunker struct {
+	client   *http.Client
+	proxyUrl string
+	sources  []string
+	username string
+	password string
+	digest   bool
+	rate     float64
+	policy   FailoverPolicy
+	frames   chan Frame
+
+	mu      sync.Mutex
+	current int
+	cancel  context.CancelFunc
+	stop    chan struct{}
+}
+
+func NewChunker(proxyUrl string, sources []string, username, password string, digest bool, rate float64, policy FailoverPolicy) (*Chunker, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source configured")
+	}
+
+	client := &http.Client{}
+
+	c := &Chunker{
+		client:   client,
+		proxyUrl: proxyUrl,
+		sources:  sources,
+		username: username,
+		password: password,
+		digest:   digest,
+		rate:     rate,
+		policy:   policy,
+		frames:   make(chan Frame),
+		stop:     make(chan struct{}),
+	}
+
+	return c, nil
+}
+
+// Frames returns the channel frames read from the upstream source are
+// published on.
+func (c *Chunker) Frames() <-chan Frame {
+	return c.frames
+}
+
+func (c *Chunker) Run() {
+	if c.policy.StickToPrimary && c.policy.HealthCheckInterval > 0 && len(c.sources) > 1 {
+		go c.watchPrimary()
+	}
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		c.mu.Lock()
+		startIndex := c.current
+		c.mu.Unlock()
+		source := c.sources[startIndex]
+
+		err := c.connect(source)
+		if err != nil {
+			upstreamReconnectsTotal.WithLabelValues(c.proxyUrl, source).Inc()
+			log.WithFields(logrus.Fields{
+				"path":   c.proxyUrl,
+				"source": source,
+				"error":  err,
+			}).Debug("chunker: reconnect")
+		}
+
+		c.advance(startIndex)
+
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(c.retryInterval()):
+		}
+	}
+}
+
+// Stop interrupts any in-flight connection and ends Run's reconnect loop.
+func (c *Chunker) Stop() {
+	c.mu.Lock()
+	cancel := c.cancel
+	c.mu.Unlock()
+
+	close(c.stop)
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// advance runs the rotation decision after a connect attempt that started
+// on startIndex returns. If current is unchanged, connect's own source
+// failed or stalled, so round-robin to the next one. If current already
+// moved (watchPrimary switched back to a healthy primary while connect was
+// running), that switch is the reason connect returned, so leave it alone
+// instead of immediately rotating past it.
+func (c *Chunker) advance(startIndex int) {
+	c.mu.Lock()
+	switchedAway := c.current != startIndex
+	c.mu.Unlock()
+
+	if len(c.sources) > 1 && !switchedAway {
+		c.failover()
+	}
+}
+
+// failover advances to the next upstream in the list, wrapping back to the
+// primary (index 0) once every source has been tried.
+func (c *Chunker) failover() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.current = (c.current + 1) % len(c.sources)
+	log.WithFields(logrus.Fields{
+		"path":   c.proxyUrl,
+		"source": c.sources[c.current],
+	}).Warn("chunker: failing over to upstream")
+}
+
+func (c *Chunker) retryInterval() time.Duration {
+	if c.policy.RetryInterval > 0 {
+		return time.Duration(c.policy.RetryInterval)
+	}
+	return 1 * time.Second
+}
+
+// watchPrimary periodically probes the primary upstream (sources[0]) and
+// switches back to it once it is reachable again, so a StickToPrimary
+// proxy doesn't keep serving from a fallback indefinitely. It exits once
+// Stop closes c.stop, otherwise it would keep running (and re-cancelling a
+// stale c.cancel) after the Chunker it belongs to has been torn down.
+func (c *Chunker) watchPrimary() {
+	ticker := time.NewTicker(time.Duration(c.policy.HealthCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		onPrimary := c.current == 0
+		c.mu.Unlock()
+		if onPrimary {
+			continue
+		}
+
+		if !c.probe(c.sources[0]) {
+			continue
+		}
+
+		c.mu.Lock()
+		c.current = 0
+		cancel := c.cancel
+		c.mu.Unlock()
+
+		log.WithFields(logrus.Fields{
+			"path":   c.proxyUrl,
+			"source": c.sources[0],
+		}).Info("chunker: primary upstream healthy again, switching back")
+		if cancel != nil {
+			cancel()
+		}
+	}
+}
+
+// do issues method against url using the Chunker's configured
+// authentication (none, basic, or digest). A digest source is tried without
+// credentials first; if the upstream challenges with a
+// WWW-Authenticate: Digest header, the request is retried once with a
+// computed Authorization header.
+func (c *Chunker) do(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %s", err)
+	}
+	if c.username != "" && !c.digest {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %s", err)
+	}
+	if !c.digest || resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("digest auth: %s", err)
+	}
+
+	authz, err := challenge.authorize(method, req.URL.RequestURI(), c.username, c.password)
+	if err != nil {
+		return nil, fmt.Errorf("digest auth: %s", err)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %s", err)
+	}
+	req.Header.Set("Authorization", authz)
+
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %s", err)
+	}
+	return resp, nil
+}
+
+// probe does a lightweight reachability check of an upstream source without
+// fully joining its MJPEG stream.
+func (c *Chunker) probe(source string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Many MJPEG cameras don't implement HEAD and answer it with a non-200
+	// status, which would make a recovered primary look unreachable
+	// forever. GET the stream instead and accept anything short of a
+	// server error as healthy rather than requiring exactly 200.
+	resp, err := c.do(ctx, "GET", source)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+func (c *Chunker) connect(source string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	defer cancel()
+
+	resp, err := c.do(ctx, "GET", source)
+	if err != nil {
+		return fmt.Errorf("connect failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			upstreamAuthFailuresTotal.WithLabelValues(c.proxyUrl, source).Inc()
+		}
+		return fmt.Errorf("connect failed: %s", resp.Status)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type: %s", err)
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok {
+		return fmt.Errorf("no boundary in content type: %s", contentType)
+	}
+
+	reader := multipart.NewReader(bufio.NewReader(resp.Body), boundary)
+
+	// Fail over if the upstream goes quiet for longer than frameTimeout,
+	// instead of blocking on NextPart() forever.
+	timer := time.AfterFunc(frameTimeout, cancel)
+	defer timer.Stop()
+
+	var lastSent time.Time
+	var seq uint64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fmt.Errorf("stream ended")
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("no frame received for %s", frameTimeout)
+			}
+			return fmt.Errorf("read frame failed: %s", err)
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("read frame data failed: %s", err)
+		}
+		timer.Reset(frameTimeout)
+
+		if c.rate > 0 {
+			interval := time.Duration(float64(time.Second) / c.rate)
+			if time.Since(lastSent) < interval {
+				continue
+			}
+		}
+
+		seq++
+		frame := Frame{
+			Data:        data,
+			ContentType: part.Header.Get("Content-Type"),
+			Time:        time.Now(),
+			Seq:         seq,
+		}
+		if frame.ContentType == "" {
+			frame.ContentType = "image/jpeg"
+		}
+
+		framesReceivedTotal.WithLabelValues(c.proxyUrl, source).Inc()
+		bytesForwardedTotal.WithLabelValues(c.proxyUrl).Add(float64(len(frame.Data)))
+		lastFrameTimestamp.WithLabelValues(c.proxyUrl).Set(float64(frame.Time.Unix()))
+
+		// A plain send would block forever if nothing is draining c.frames
+		// anymore (e.g. PubSub.run already returned via its own s.stop case
+		// during a Close), leaking this goroutine and the upstream
+		// connection along with it.
+		select {
+		case c.frames <- frame:
+			lastSent = frame.Time
+		case <-c.stop:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("frame send interrupted: %s", ctx.Err())
+		}
+	}
+}
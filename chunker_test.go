@@ -0,0 +1,87 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "testing"
+
+// TestChunkerAdvance covers the rotation decision Run makes after a connect
+// attempt returns: plain round-robin across sources, wrap-around back to
+// the primary, and leaving a watchPrimary switch-back alone instead of
+// immediately rotating past it.
+func TestChunkerAdvance(t *testing.T) {
+	tests := []struct {
+		name         string
+		numSources   int
+		startCurrent int
+		startIndex   int // index Run captured before connect, passed to advance
+		wantCurrent  int
+	}{
+		{
+			name:         "rotates to next source",
+			numSources:   3,
+			startCurrent: 0,
+			startIndex:   0,
+			wantCurrent:  1,
+		},
+		{
+			name:         "wraps back to primary",
+			numSources:   3,
+			startCurrent: 2,
+			startIndex:   2,
+			wantCurrent:  0,
+		},
+		{
+			name:         "single source never rotates",
+			numSources:   1,
+			startCurrent: 0,
+			startIndex:   0,
+			wantCurrent:  0,
+		},
+		{
+			name:         "leaves a watchPrimary switch-back alone",
+			numSources:   3,
+			startCurrent: 0, // watchPrimary already switched 1 -> 0 while connect(1) ran
+			startIndex:   1,
+			wantCurrent:  0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := make([]string, tt.numSources)
+			for i := range sources {
+				sources[i] = "http://example.com/source"
+			}
+
+			c, err := NewChunker("/test", sources, "", "", false, 0, FailoverPolicy{})
+			if err != nil {
+				t.Fatalf("NewChunker() = %v, want no error", err)
+			}
+			c.current = tt.startCurrent
+
+			c.advance(tt.startIndex)
+
+			if c.current != tt.wantCurrent {
+				t.Errorf("advance(%d) with current=%d left current=%d, want %d",
+					tt.startIndex, tt.startCurrent, c.current, tt.wantCurrent)
+			}
+		})
+	}
+}
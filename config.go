@@ -0,0 +1,95 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the unified configuration format loaded via the -config flag.
+// It supersedes -sources and additionally lets listeners and process-wide
+// defaults be set from the same file instead of passed as flags.
+type Config struct {
+	Sources       []configSource
+	Listeners     []ListenerConfig
+	FrameTimeout  Duration
+	StopDelay     Duration
+	TCPSendBuffer int
+}
+
+// decodeConfigFile decodes filename into v, picking the format (JSON, TOML,
+// or YAML) from the file extension. It is shared by readConfig (the
+// []configSource-only SOURCES_JSON/-sources path) and loadConfigFile (the
+// unified -config path).
+func decodeConfigFile(filename string, v interface{}) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.WithError(err).WithField("file", file.Name()).Warn("config: file close failed")
+		}
+	}()
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json", "":
+		dec := json.NewDecoder(file)
+		if err := dec.Decode(v); err != nil && err != io.EOF {
+			return err
+		}
+
+	case ".toml":
+		if _, err := toml.NewDecoder(file).Decode(v); err != nil {
+			return err
+		}
+
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(file)
+		if err := dec.Decode(v); err != nil && err != io.EOF {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported config file extension: %s", ext)
+	}
+
+	return nil
+}
+
+// loadConfigFile reads filename into a Config. Unlike readConfig, it also
+// carries listeners and the process-wide defaults that would otherwise have
+// to be passed as flags, so a deployment can be described by one file.
+func loadConfigFile(filename string) (*Config, error) {
+	cfg := &Config{}
+	if err := decodeConfigFile(filename, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
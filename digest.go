@@ -0,0 +1,119 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest
+// challenge, as returned by an upstream that requires RFC 7616 digest
+// authentication instead of (or in addition to) basic auth.
+type digestChallenge struct {
+	realm  string
+	nonce  string
+	qop    string
+	opaque string
+}
+
+// parseDigestChallenge parses the value of a 401 response's
+// WWW-Authenticate header into a digestChallenge.
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	const prefix = "Digest "
+	if !strings.HasPrefix(header, prefix) {
+		return nil, fmt.Errorf("not a digest challenge: %q", header)
+	}
+
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(header, prefix), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+
+	challenge := &digestChallenge{
+		realm:  params["realm"],
+		nonce:  params["nonce"],
+		qop:    params["qop"],
+		opaque: params["opaque"],
+	}
+	if challenge.realm == "" || challenge.nonce == "" {
+		return nil, fmt.Errorf("incomplete digest challenge: %q", header)
+	}
+
+	return challenge, nil
+}
+
+// authorize computes the Authorization header value for method/uri using
+// username/password, per RFC 7616 (MD5, qop=auth when the challenge offers
+// it, RFC 2069-style otherwise).
+func (d *digestChallenge) authorize(method, uri, username, password string) (string, error) {
+	cnonce, err := randomNonce()
+	if err != nil {
+		return "", err
+	}
+
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", username, d.realm, password))
+	ha2 := md5Hex(fmt.Sprintf("%s:%s", method, uri))
+	const nc = "00000001"
+	response := digestResponse(ha1, ha2, d.nonce, nc, cnonce, d.qop)
+
+	header := fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, d.realm, d.nonce, uri, response,
+	)
+	if d.qop != "" {
+		header += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, d.qop, nc, cnonce)
+	}
+	if d.opaque != "" {
+		header += fmt.Sprintf(`, opaque="%s"`, d.opaque)
+	}
+
+	return header, nil
+}
+
+// digestResponse computes the "response" value of RFC 7616 section 3.4.1:
+// MD5(HA1:nonce:nc:cnonce:qop:HA2) with qop=auth, or the legacy RFC 2069
+// MD5(HA1:nonce:HA2) when the challenge didn't offer a qop.
+func digestResponse(ha1, ha2, nonce, nc, cnonce, qop string) string {
+	if qop != "" {
+		return md5Hex(strings.Join([]string{ha1, nonce, nc, cnonce, qop, ha2}, ":"))
+	}
+	return md5Hex(strings.Join([]string{ha1, nonce, ha2}, ":"))
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomNonce() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate cnonce: %s", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,101 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr bool
+	}{
+		{
+			name:   "qop auth",
+			header: `Digest realm="camera", nonce="abc123", qop="auth", opaque="xyz"`,
+		},
+		{
+			name:   "no qop",
+			header: `Digest realm="camera", nonce="abc123"`,
+		},
+		{
+			name:    "not digest",
+			header:  `Basic realm="camera"`,
+			wantErr: true,
+		},
+		{
+			name:    "missing nonce",
+			header:  `Digest realm="camera"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := parseDigestChallenge(tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDigestChallenge(%q) = nil error, want error", tt.header)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDigestChallenge(%q) = %v, want no error", tt.header, err)
+			}
+			if challenge.realm != "camera" || challenge.nonce != "abc123" {
+				t.Fatalf("parseDigestChallenge(%q) = %+v, want realm=camera nonce=abc123", tt.header, challenge)
+			}
+		})
+	}
+}
+
+// TestDigestResponse checks digestResponse against the worked example from
+// RFC 2617 section 3.5.
+func TestDigestResponse(t *testing.T) {
+	ha1 := md5Hex("Mufasa:testrealm@host.com:Circle Of Life")
+	ha2 := md5Hex("GET:/dir/index.html")
+
+	got := digestResponse(ha1, ha2, "dcd98b7102dd2f0e8b11d0f600bfb0c093", "00000001", "0a4f113b", "auth")
+	want := "6629fae49393a05397450978507c4ef1"
+	if got != want {
+		t.Errorf("digestResponse() = %s, want %s", got, want)
+	}
+}
+
+func TestDigestChallengeAuthorize(t *testing.T) {
+	challenge := &digestChallenge{realm: "camera", nonce: "abc123", qop: "auth", opaque: "xyz"}
+
+	header, err := challenge.authorize("GET", "/stream.mjpg", "user", "pass")
+	if err != nil {
+		t.Fatalf("authorize() = %v, want no error", err)
+	}
+
+	for _, want := range []string{
+		`username="user"`, `realm="camera"`, `nonce="abc123"`, `uri="/stream.mjpg"`,
+		"qop=auth", "nc=00000001", `opaque="xyz"`,
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("authorize() = %q, want it to contain %q", header, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/sargassum-world/mjpeg-proxy/rpc"
+)
+
+// frameStreamServer implements rpc.FrameStreamServer, sourcing frames from
+// whichever PubSub is currently registered for the requested path.
+type frameStreamServer struct {
+	rpc.UnimplementedFrameStreamServer
+	registry *Registry
+}
+
+func newFrameStreamServer(registry *Registry) *frameStreamServer {
+	return &frameStreamServer{registry: registry}
+}
+
+func (s *frameStreamServer) Subscribe(req *rpc.SubscribeRequest, stream rpc.FrameStream_SubscribeServer) error {
+	pubSub, ok := s.registry.Lookup(req.Path)
+	if !ok {
+		return status.Errorf(codes.NotFound, "no such proxy path: %s", req.Path)
+	}
+
+	ch := pubSub.subscribe()
+	defer pubSub.unsubscribe(ch)
+
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			err := stream.Send(&rpc.Frame{
+				Data:        frame.Data,
+				ContentType: frame.ContentType,
+				Timestamp:   frame.Time.UnixNano(),
+				Seq:         frame.Seq,
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
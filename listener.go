@@ -0,0 +1,163 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/soheilhy/cmux"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+
+	"github.com/sargassum-world/mjpeg-proxy/rpc"
+)
+
+// ListenerConfig describes one address the proxy should listen and serve
+// the registered MJPEG handlers on. Addr is the only required field; the
+// rest select plain HTTP, static TLS, mTLS, or ACME (Let's Encrypt) serving
+// on that address.
+type ListenerConfig struct {
+	Addr         string
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ACMEHost     string
+}
+
+// listen opens the net.Listener for this ListenerConfig, wrapping it in TLS
+// when the config calls for it.
+func (lc ListenerConfig) listen() (net.Listener, error) {
+	var listener net.Listener
+	var err error
+
+	if strings.HasPrefix(lc.Addr, "unix:") {
+		listener, err = unixListen(strings.TrimPrefix(lc.Addr, "unix:"))
+	} else {
+		listener, err = net.Listen("tcp", lc.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := lc.tlsConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	return listener, nil
+}
+
+func (lc ListenerConfig) tlsConfig() (*tls.Config, error) {
+	switch {
+	case lc.ACMEHost != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(lc.ACMEHost),
+			Cache:      autocert.DirCache("acme-cache"),
+		}
+		return manager.TLSConfig(), nil
+
+	case lc.CertFile != "" || lc.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load cert/key failed: %s", err)
+		}
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+
+		if lc.ClientCAFile != "" {
+			pem, err := os.ReadFile(lc.ClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("read client CA failed: %s", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", lc.ClientCAFile)
+			}
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		return config, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// loadListeners reads a JSON array of ListenerConfig from filename, the
+// sibling config file referenced by the -listeners flag.
+func loadListeners(filename string) ([]ListenerConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	listeners := make([]ListenerConfig, 0)
+	dec := json.NewDecoder(file)
+	err = dec.Decode(&listeners)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return listeners, nil
+}
+
+// serveListener opens lc and demultiplexes it with cmux into the MJPEG
+// HTTP server and the gRPC FrameStream server, so both protocols are
+// reachable on the same address.
+func serveListener(lc ListenerConfig) error {
+	listener, err := lc.listen()
+	if err != nil {
+		return err
+	}
+
+	log.WithField("addr", lc.Addr).Info("server: starting listener")
+
+	m := cmux.New(listener)
+	grpcListener := m.Match(cmux.HTTP2HeaderField("content-type", "application/grpc"))
+	httpListener := m.Match(cmux.Any())
+
+	httpServer := &http.Server{
+		Handler:   serveMux,
+		ConnState: connStateEvent,
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterFrameStreamServer(grpcServer, newFrameStreamServer(globalRegistry))
+
+	go httpServer.Serve(httpListener)
+	go grpcServer.Serve(grpcListener)
+
+	return m.Serve()
+}
@@ -0,0 +1,50 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// log is the process-wide structured logger, configured from the
+// -log-format and -log-level flags in main().
+var log = logrus.New()
+
+// initLogging configures the global logger's output format and verbosity.
+func initLogging(format, level string) error {
+	switch format {
+	case "json":
+		log.SetFormatter(&logrus.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&logrus.TextFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("unknown log level: %s", level)
+	}
+	log.SetLevel(parsed)
+
+	return nil
+}
@@ -0,0 +1,75 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Metrics are labeled by path (the proxy path a source is registered at);
+// the upstream ones (frames received, reconnects, auth failures) are also
+// labeled by source (the upstream URL in use), so a Grafana dashboard can
+// break health down per camera and per failover target.
+var (
+	framesReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mjpeg_proxy_frames_received_total",
+		Help: "Frames received from the upstream source.",
+	}, []string{"path", "source"})
+
+	framesDroppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mjpeg_proxy_frames_dropped_total",
+		Help: "Frames dropped because a subscriber could not keep up.",
+	}, []string{"path"})
+
+	bytesForwardedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mjpeg_proxy_bytes_forwarded_total",
+		Help: "Frame bytes forwarded to subscribers.",
+	}, []string{"path"})
+
+	activeSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mjpeg_proxy_active_subscribers",
+		Help: "Number of clients currently subscribed to a path.",
+	}, []string{"path"})
+
+	upstreamReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mjpeg_proxy_upstream_reconnects_total",
+		Help: "Number of times the chunker had to reconnect to an upstream.",
+	}, []string{"path", "source"})
+
+	upstreamAuthFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mjpeg_proxy_upstream_auth_failures_total",
+		Help: "Number of upstream connection attempts rejected for bad credentials.",
+	}, []string{"path", "source"})
+
+	lastFrameTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mjpeg_proxy_last_frame_timestamp_seconds",
+		Help: "Unix timestamp of the last frame received from the upstream source.",
+	}, []string{"path"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		framesReceivedTotal,
+		framesDroppedTotal,
+		bytesForwardedTotal,
+		activeSubscribers,
+		upstreamReconnectsTotal,
+		upstreamAuthFailuresTotal,
+		lastFrameTimestamp,
+	)
+}
@@ -23,82 +23,160 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
-	"strings"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	clientHeader  string
 	frameTimeout  time.Duration
+	clientTimeout time.Duration
 	stopDelay     time.Duration
 	tcpSendBuffer int
 )
 
-type configSource struct {
-	Source   string
-	Username string
-	Password string
-	Digest   bool
-	Path     string
-	Rate     float64
+// SourceList is the list of upstream URLs configured for a proxy path. In
+// JSON it may be written as a single string (one upstream) or as an array
+// of strings (a primary followed by fallbacks).
+type SourceList []string
+
+func (s *SourceList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = SourceList{single}
+		return nil
+	}
+
+	var multi []string
+	if err := json.Unmarshal(data, &multi); err != nil {
+		return err
+	}
+	*s = SourceList(multi)
+	return nil
 }
 
-func startSource(source, username, password, proxyUrl string, digest bool, rate float64) error {
-	chunker, err := NewChunker(proxyUrl, source, username, password, digest, rate)
-	if err != nil {
-		return fmt.Errorf("chunker[%s]: create failed: %s", proxyUrl, err)
+// UnmarshalTOML implements toml.Unmarshaler, since a TOML decoder gives us
+// the already-typed value instead of raw bytes like encoding/json does.
+func (s *SourceList) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*s = SourceList{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("source list entries must be strings")
+			}
+			list = append(list, str)
+		}
+		*s = SourceList(list)
+	default:
+		return fmt.Errorf("invalid source value: %v", data)
 	}
-	pubSub := NewPubSub(proxyUrl, chunker)
-	pubSub.Start()
+	return nil
+}
 
-	fmt.Printf("chunker[%s]: serving from %s\n", proxyUrl, source)
-	http.Handle(proxyUrl, pubSub)
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *SourceList) UnmarshalYAML(value *yaml.Node) error {
+	var single string
+	if err := value.Decode(&single); err == nil {
+		*s = SourceList{single}
+		return nil
+	}
 
+	var multi []string
+	if err := value.Decode(&multi); err != nil {
+		return err
+	}
+	*s = SourceList(multi)
 	return nil
 }
 
-func loadConfig(filename string) error {
-	file, err := os.Open(filename)
+// Duration wraps time.Duration so it can be configured in JSON, TOML, or
+// YAML as a Go duration string (e.g. "30s") instead of a raw nanosecond
+// count.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			fmt.Printf("config: file close failed for %s: %s\n", file.Name(), err)
-		}
-	}()
 
-	sources := make([]configSource, 0)
-	dec := json.NewDecoder(file)
-	err = dec.Decode(&sources)
-	if err != nil && err != io.EOF {
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, which both the TOML
+// and YAML decoders use for scalar values.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
 		return err
 	}
 
+	*d = Duration(parsed)
+	return nil
+}
+
+// FailoverPolicy controls how a Chunker behaves when a proxy path has more
+// than one upstream source configured.
+type FailoverPolicy struct {
+	RetryInterval       Duration
+	StickToPrimary      bool
+	HealthCheckInterval Duration
+}
+
+type configSource struct {
+	Source         SourceList
+	Username       string
+	Password       string
+	Digest         bool
+	Path           string
+	Rate           float64
+	FailoverPolicy FailoverPolicy
+}
+
+// readConfig parses an array of configSource from filename, without
+// starting anything. The format (JSON, TOML, or YAML) is picked from the
+// file extension. Used both for the initial source list and for
+// Registry.Reload on SIGHUP.
+func readConfig(filename string) ([]configSource, error) {
+	sources := make([]configSource, 0)
+	if err := decodeConfigFile(filename, &sources); err != nil {
+		return nil, err
+	}
+
 	exists := make(map[string]bool)
 	for _, conf := range sources {
 		if exists[conf.Path] {
-			return fmt.Errorf("duplicate proxy path: %s", conf.Path)
-		}
-
-		err = startSource(conf.Source, conf.Username, conf.Password, conf.Path, conf.Digest, conf.Rate)
-		if err != nil {
-			return err
+			return nil, fmt.Errorf("duplicate proxy path: %s", conf.Path)
 		}
-
 		exists[conf.Path] = true
 	}
 
-	return nil
+	return sources, nil
 }
 
 func connStateEvent(conn net.Conn, event http.ConnState) {
+	log.WithFields(logrus.Fields{
+		"client_addr": conn.RemoteAddr(),
+		"state":       event,
+	}).Debug("server: connection state changed")
+
 	if event == http.StateActive && tcpSendBuffer > 0 {
 		switch c := conn.(type) {
 		case *net.TCPConn:
@@ -118,26 +196,6 @@ func unixListen(path string) (net.Listener, error) {
 	return net.Listen("unix", path)
 }
 
-func listenAndServe(addr string) error {
-	var listener net.Listener
-	var err error
-
-	if strings.HasPrefix(addr, "unix:") {
-		listener, err = unixListen(strings.TrimPrefix(addr, "unix:"))
-	} else {
-		listener, err = net.Listen("tcp", addr)
-	}
-	if err != nil {
-		return err
-	}
-
-	fmt.Printf("server: starting on address %s\n", addr)
-	server := &http.Server{
-		ConnState: connStateEvent,
-	}
-	return server.Serve(listener)
-}
-
 func lookupEnvOrString(key string, defaultVal string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -151,8 +209,10 @@ func main() {
 	username := flag.String("username", lookupEnvOrString("SOURCE_USERNAME", ""), "source uri username")
 	password := flag.String("password", lookupEnvOrString("SOURCE_PASSWORD", ""), "source uri password")
 	digest := flag.Bool("digest", false, "source uri uses digest authentication")
-	sources := flag.String("sources", lookupEnvOrString("SOURCES_JSON", ""), "JSON configuration file to load sources from")
+	sources := flag.String("sources", lookupEnvOrString("SOURCES_JSON", ""), "JSON/TOML/YAML configuration file to load sources from")
+	configFile := flag.String("config", lookupEnvOrString("CONFIG_FILE", ""), "JSON/TOML/YAML configuration file with sources, listeners, and defaults in one place (supersedes -sources)")
 	bind := flag.String("bind", lookupEnvOrString("SERVE_BIND", ":8080"), "proxy bind address")
+	listeners := flag.String("listeners", lookupEnvOrString("LISTENERS_JSON", ""), "JSON configuration file with listeners (TLS, mTLS, ACME) to serve on instead of -bind")
 	path := flag.String("path", lookupEnvOrString("SERVE_PATH", "/"), "proxy serving path")
 	rate := flag.Float64("rate", 0, "limit output frame rate")
 	maxprocs := flag.Int("maxprocs", 0, "limit number of CPUs used")
@@ -160,26 +220,113 @@ func main() {
 	flag.DurationVar(&stopDelay, "stopduration", 60*time.Second, "follow source after last client")
 	flag.IntVar(&tcpSendBuffer, "sendbuffer", 4096, "limit buffering of frames")
 	flag.StringVar(&clientHeader, "clientheader", "", "request header with client address")
+	logFormat := flag.String("log-format", lookupEnvOrString("LOG_FORMAT", "text"), "log output format (text, json)")
+	logLevel := flag.String("log-level", lookupEnvOrString("LOG_LEVEL", "info"), "log verbosity (debug, info, warn, error)")
+	adminToken := flag.String("admin-token", lookupEnvOrString("ADMIN_TOKEN", ""), "bearer token for the admin API (admin API is disabled if unset)")
+	metricsPath := flag.String("metrics-path", lookupEnvOrString("METRICS_PATH", "/metrics"), "path to serve Prometheus metrics on")
 	flag.Parse()
 
+	if err := initLogging(*logFormat, *logLevel); err != nil {
+		fmt.Println("log:", err)
+		os.Exit(1)
+	}
+
 	if *maxprocs > 0 {
 		runtime.GOMAXPROCS(*maxprocs)
 	}
 
+	var cfg *Config
+	if *configFile != "" {
+		var err error
+		cfg, err = loadConfigFile(*configFile)
+		if err != nil {
+			log.WithError(err).Fatal("config: failed to load -config")
+		}
+	}
+
+	if cfg != nil {
+		if cfg.FrameTimeout > 0 {
+			frameTimeout = time.Duration(cfg.FrameTimeout)
+		}
+		if cfg.StopDelay > 0 {
+			stopDelay = time.Duration(cfg.StopDelay)
+		}
+		if cfg.TCPSendBuffer > 0 {
+			tcpSendBuffer = cfg.TCPSendBuffer
+		}
+	}
+
+	// clientTimeout must be longer than frameTimeout: frameTimeout is what
+	// triggers the chunker to fail over to the next source, and a failover
+	// needs time to reconnect before the next frame arrives. If a
+	// subscriber's read loop timed out at the same threshold, every
+	// subscriber would be dropped at the exact moment a failover begins.
+	clientTimeout = 2 * frameTimeout
+
+	registry := NewRegistry(serveMux)
+	globalRegistry = registry
+	serveMux.Handle(adminSourcesPath, &adminHandler{registry: registry, token: *adminToken})
+	serveMux.Handle(*metricsPath, promhttp.Handler())
+
 	var err error
-	if *sources != "" {
-		err = loadConfig(*sources)
-	} else {
-		err = startSource(*source, *username, *password, *path, *digest, *rate)
+	switch {
+	case cfg != nil:
+		for _, conf := range cfg.Sources {
+			if err = registry.Add(conf); err != nil {
+				break
+			}
+		}
+	case *sources != "":
+		var confs []configSource
+		confs, err = readConfig(*sources)
+		if err == nil {
+			for _, conf := range confs {
+				if err = registry.Add(conf); err != nil {
+					break
+				}
+			}
+		}
+	default:
+		err = registry.Add(configSource{
+			Source:   SourceList{*source},
+			Username: *username,
+			Password: *password,
+			Digest:   *digest,
+			Path:     *path,
+			Rate:     *rate,
+		})
 	}
 	if err != nil {
-		fmt.Println("config:", err)
-		os.Exit(1)
+		log.WithError(err).Fatal("config: failed to start sources")
 	}
 
-	err = listenAndServe(*bind)
-	if err != nil {
-		fmt.Println("server:", err)
-		os.Exit(1)
+	switch {
+	case cfg != nil:
+		watchSIGHUP(registry.ReloadConfigFile, *configFile)
+	case *sources != "":
+		watchSIGHUP(registry.Reload, *sources)
+	}
+
+	listenerConfigs := []ListenerConfig{{Addr: *bind}}
+	switch {
+	case cfg != nil && len(cfg.Listeners) > 0:
+		listenerConfigs = cfg.Listeners
+	case *listeners != "":
+		listenerConfigs, err = loadListeners(*listeners)
+		if err != nil {
+			log.WithError(err).Fatal("listeners: failed to load config")
+		}
+	}
+
+	errc := make(chan error, len(listenerConfigs))
+	for _, lc := range listenerConfigs {
+		lc := lc
+		go func() {
+			errc <- serveListener(lc)
+		}()
+	}
+
+	if err := <-errc; err != nil {
+		log.WithError(err).Fatal("server: failed")
 	}
 }
@@ -0,0 +1,86 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// dynamicMux is an http.Handler backed by a map of patterns to handlers
+// guarded by a RWMutex, so sources can be registered and deregistered while
+// the server is running without restarting it. Unlike http.ServeMux it
+// supports removing a previously registered pattern.
+type dynamicMux struct {
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+func newDynamicMux() *dynamicMux {
+	return &dynamicMux{handlers: make(map[string]http.Handler)}
+}
+
+// Handle registers h for pattern, replacing any handler already registered
+// for it. A pattern ending in "/" matches that path and everything below
+// it, like http.ServeMux; any other pattern matches only exactly.
+func (m *dynamicMux) Handle(pattern string, h http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[pattern] = h
+}
+
+// Remove deregisters pattern, if any handler was registered for it.
+func (m *dynamicMux) Remove(pattern string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, pattern)
+}
+
+func (m *dynamicMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The lock is held only for the lookup, not while the handler runs:
+	// MJPEG streams are long-lived, and the admin API itself calls Handle and
+	// Remove from inside a handler.
+	m.mu.RLock()
+	bestHandler, ok := m.handlers[r.URL.Path]
+	if !ok {
+		var bestPattern string
+		for pattern, h := range m.handlers {
+			if !strings.HasSuffix(pattern, "/") {
+				continue
+			}
+			if strings.HasPrefix(r.URL.Path, pattern) && len(pattern) > len(bestPattern) {
+				bestPattern = pattern
+				bestHandler = h
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	if bestHandler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	bestHandler.ServeHTTP(w, r)
+}
+
+// serveMux is the single handler shared by every listener, so sources
+// added or removed via SIGHUP or the admin API take effect everywhere.
+var serveMux = newDynamicMux()
@@ -0,0 +1,195 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const multipartBoundary = "mjpegproxy"
+
+// PubSub republishes the frames read by a Chunker to any number of HTTP
+// clients, dropping frames for a subscriber that can't keep up with the
+// source.
+// A Chunker failing over between upstreams only pauses publishing; it never
+// closes the frames channel, so subscribers stay connected through the gap.
+type PubSub struct {
+	path    string
+	chunker *Chunker
+
+	mu        sync.Mutex
+	subs      map[chan Frame]bool
+	lastFrame Frame
+	haveFrame bool
+	stop      chan struct{}
+}
+
+func NewPubSub(path string, chunker *Chunker) *PubSub {
+	return &PubSub{
+		path:    path,
+		chunker: chunker,
+		subs:    make(map[chan Frame]bool),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (s *PubSub) Start() {
+	go s.chunker.Run()
+	go s.run()
+}
+
+func (s *PubSub) run() {
+	for {
+		select {
+		case frame := <-s.chunker.Frames():
+			s.publish(frame)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the underlying chunker and disconnects every subscriber. It
+// is used when a source is removed via SIGHUP or the admin API; unlike a
+// failover, a removal must make clients notice the stream is gone.
+func (s *PubSub) Close() {
+	s.chunker.Stop()
+	close(s.stop)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		close(ch)
+		delete(s.subs, ch)
+	}
+}
+
+func (s *PubSub) subscribe() chan Frame {
+	ch := make(chan Frame, 4)
+
+	s.mu.Lock()
+	s.subs[ch] = true
+	s.mu.Unlock()
+
+	activeSubscribers.WithLabelValues(s.path).Inc()
+	return ch
+}
+
+func (s *PubSub) unsubscribe(ch chan Frame) {
+	activeSubscribers.WithLabelValues(s.path).Dec()
+
+	s.mu.Lock()
+	delete(s.subs, ch)
+	s.mu.Unlock()
+}
+
+// Snapshot returns the most recently published frame, if any.
+func (s *PubSub) Snapshot() (Frame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastFrame, s.haveFrame
+}
+
+func (s *PubSub) publish(frame Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastFrame = frame
+	s.haveFrame = true
+
+	for ch := range s.subs {
+		select {
+		case ch <- frame:
+		default:
+			framesDroppedTotal.WithLabelValues(s.path).Inc()
+			log.WithField("path", s.path).Debug("pubsub: dropping frame for slow subscriber")
+		}
+	}
+}
+
+func (s *PubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+
+	clientAddr := r.RemoteAddr
+	if clientHeader != "" {
+		if h := r.Header.Get(clientHeader); h != "" {
+			clientAddr = h
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"path":        s.path,
+		"client_addr": clientAddr,
+	}).Info("pubsub: client connected")
+
+	var frameCount uint64
+	defer func() {
+		log.WithFields(logrus.Fields{
+			"path":        s.path,
+			"client_addr": clientAddr,
+			"frame_count": frameCount,
+		}).Info("pubsub: client disconnected")
+	}()
+
+	w.Header().Set("Content-Type", fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", multipartBoundary))
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n",
+				multipartBoundary, frame.ContentType, len(frame.Data))
+			if err != nil {
+				return
+			}
+			if _, err := w.Write(frame.Data); err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, "\r\n"); err != nil {
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+			frameCount++
+		case <-r.Context().Done():
+			return
+		case <-time.After(clientTimeout):
+			log.WithFields(logrus.Fields{
+				"path":        s.path,
+				"client_addr": clientAddr,
+				"frame_count": frameCount,
+			}).Warn("pubsub: frame timeout for client")
+			return
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+const adminSourcesPath = "/-/admin/sources"
+
+// globalRegistry is the single Registry for the process, set by main once
+// at startup. The gRPC server looks sources up through it.
+var globalRegistry *Registry
+
+// sourceEntry tracks the running Chunker/PubSub for one configured path.
+type sourceEntry struct {
+	conf    configSource
+	chunker *Chunker
+	pubSub  *PubSub
+}
+
+// Registry owns every currently running source and registers/deregisters
+// their handlers on mux, so sources can be added, updated, and removed
+// while the process keeps serving.
+type Registry struct {
+	mux *dynamicMux
+
+	mu      sync.Mutex
+	entries map[string]*sourceEntry
+}
+
+func NewRegistry(mux *dynamicMux) *Registry {
+	return &Registry{
+		mux:     mux,
+		entries: make(map[string]*sourceEntry),
+	}
+}
+
+// Add starts a new source at conf.Path. It fails if the path is already
+// registered; use Update to replace an existing source.
+func (r *Registry) Add(conf configSource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.add(conf)
+}
+
+func (r *Registry) add(conf configSource) error {
+	if _, exists := r.entries[conf.Path]; exists {
+		return fmt.Errorf("duplicate proxy path: %s", conf.Path)
+	}
+
+	chunker, err := NewChunker(conf.Path, conf.Source, conf.Username, conf.Password, conf.Digest, conf.Rate, conf.FailoverPolicy)
+	if err != nil {
+		return fmt.Errorf("chunker[%s]: create failed: %s", conf.Path, err)
+	}
+	pubSub := NewPubSub(conf.Path, chunker)
+	pubSub.Start()
+
+	r.mux.Handle(conf.Path, pubSub)
+	r.mux.Handle(snapshotPath(conf.Path), &snapshotHandler{pubSub})
+	r.entries[conf.Path] = &sourceEntry{conf: conf, chunker: chunker, pubSub: pubSub}
+
+	log.WithField("path", conf.Path).Info("registry: source added")
+	return nil
+}
+
+// Remove stops and deregisters the source at path.
+func (r *Registry) Remove(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(path)
+}
+
+func (r *Registry) remove(path string) error {
+	entry, ok := r.entries[path]
+	if !ok {
+		return fmt.Errorf("no such proxy path: %s", path)
+	}
+
+	r.mux.Remove(path)
+	r.mux.Remove(snapshotPath(path))
+	entry.pubSub.Close()
+	delete(r.entries, path)
+
+	log.WithField("path", path).Info("registry: source removed")
+	return nil
+}
+
+// Update replaces the source at conf.Path with a fresh one, restarting the
+// chunker even if conf is unchanged.
+func (r *Registry) Update(conf configSource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[conf.Path]; ok {
+		if err := r.remove(conf.Path); err != nil {
+			return err
+		}
+	}
+	return r.add(conf)
+}
+
+// Lookup returns the PubSub currently serving path, if any. Used by the
+// gRPC FrameStream service to find the stream a client is subscribing to.
+func (r *Registry) Lookup(path string) (*PubSub, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[path]
+	if !ok {
+		return nil, false
+	}
+	return entry.pubSub, true
+}
+
+// List returns the configuration of every currently running source.
+func (r *Registry) List() []configSource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	confs := make([]configSource, 0, len(r.entries))
+	for _, entry := range r.entries {
+		confs = append(confs, entry.conf)
+	}
+	return confs
+}
+
+// Reload re-reads filename (a []configSource file, the -sources format) and
+// diffs it against the running sources. This is the SIGHUP handler for the
+// -sources path.
+func (r *Registry) Reload(filename string) error {
+	confs, err := readConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	return r.reloadSources(confs)
+}
+
+// ReloadConfigFile re-reads filename (a unified Config file, the -config
+// format) and diffs its sources against the running sources. This is the
+// SIGHUP handler for the -config path.
+func (r *Registry) ReloadConfigFile(filename string) error {
+	cfg, err := loadConfigFile(filename)
+	if err != nil {
+		return err
+	}
+
+	return r.reloadSources(cfg.Sources)
+}
+
+// reloadSources diffs confs against the running sources: paths no longer
+// present are stopped, new paths are started, and paths whose configuration
+// changed are restarted. Shared by Reload and ReloadConfigFile.
+func (r *Registry) reloadSources(confs []configSource) error {
+	wanted := make(map[string]configSource, len(confs))
+	for _, conf := range confs {
+		wanted[conf.Path] = conf
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for path := range r.entries {
+		if _, ok := wanted[path]; ok {
+			continue
+		}
+		if err := r.remove(path); err != nil {
+			log.WithError(err).WithField("path", path).Warn("registry: reload failed to remove source")
+		}
+	}
+
+	for path, conf := range wanted {
+		existing, ok := r.entries[path]
+		if ok && reflect.DeepEqual(existing.conf, conf) {
+			continue
+		}
+		if ok {
+			if err := r.remove(path); err != nil {
+				log.WithError(err).WithField("path", path).Warn("registry: reload failed to remove source")
+				continue
+			}
+		}
+		if err := r.add(conf); err != nil {
+			log.WithError(err).WithField("path", path).Warn("registry: reload failed to add source")
+		}
+	}
+
+	return nil
+}
+
+// watchSIGHUP calls reload every time the process receives SIGHUP, so
+// sources can be added, removed, and updated without restarting. filename is
+// logged and passed to reload, which is Registry.Reload or
+// Registry.ReloadConfigFile depending on the format of the file in use.
+func watchSIGHUP(reload func(filename string) error, filename string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	go func() {
+		for range sighup {
+			log.WithField("file", filename).Info("registry: reloading config on SIGHUP")
+			if err := reload(filename); err != nil {
+				log.WithError(err).Warn("registry: reload failed")
+			}
+		}
+	}()
+}
+
+// adminHandler implements the GET/PUT/DELETE admin API for mutating
+// individual sources at runtime, e.g. at /-/admin/sources.
+type adminHandler struct {
+	registry *Registry
+	token    string
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	presented := r.Header.Get("Authorization")
+	expected := "Bearer " + h.token
+	if h.token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.registry.List())
+
+	case http.MethodPut:
+		var conf configSource
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if conf.Path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		if err := h.registry.Update(conf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "path query parameter is required", http.StatusBadRequest)
+			return
+		}
+		if err := h.registry.Remove(path); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
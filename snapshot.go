@@ -0,0 +1,72 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotPath derives the snapshot URL for a proxy path, e.g. "/cam1" or
+// "/cam1/" both become "/cam1/snapshot.jpg".
+func snapshotPath(proxyUrl string) string {
+	if strings.HasSuffix(proxyUrl, "/") {
+		return proxyUrl + "snapshot.jpg"
+	}
+	return proxyUrl + "/snapshot.jpg"
+}
+
+// snapshotHandler serves the most recently received frame from a PubSub as
+// a single image/jpeg response, without opening a multipart MJPEG stream.
+type snapshotHandler struct {
+	pubSub *PubSub
+}
+
+func (h *snapshotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	frame, ok := h.pubSub.Snapshot()
+	if !ok || time.Since(frame.Time) > frameTimeout {
+		var fresh bool
+		frame, fresh = h.waitForFrame()
+		if !fresh {
+			http.Error(w, "no frame available", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", frame.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(frame.Data)))
+	w.Write(frame.Data)
+}
+
+// waitForFrame subscribes to the PubSub just long enough to receive one
+// fresh frame, then unsubscribes.
+func (h *snapshotHandler) waitForFrame() (Frame, bool) {
+	ch := h.pubSub.subscribe()
+	defer h.pubSub.unsubscribe(ch)
+
+	select {
+	case frame, ok := <-ch:
+		return frame, ok
+	case <-time.After(frameTimeout):
+		return Frame{}, false
+	}
+}